@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// backendClient fetches tiles from a CT log backend over a connection-pooled, rate-limited
+// *http.Client, retrying retryable failures (429s, 5xxs, and network errors) with
+// exponential backoff and jitter. Other 4xx responses are never retried; they're propagated to
+// the caller as a statusCodeError so ctile can pass the backend's status code through.
+type backendClient struct {
+	httpClient *http.Client
+	limiter    *rate.Limiter
+	maxRetries int
+}
+
+// newBackendClient builds a backendClient. connectTimeout bounds dialing a new connection;
+// readTimeout bounds an entire request round trip (connect, write, and read the response).
+// maxIdleConns sets the size of the connection pool kept warm for the backend.
+func newBackendClient(connectTimeout, readTimeout time.Duration, maxIdleConns int, qps float64, burst int) *backendClient {
+	dialer := &net.Dialer{Timeout: connectTimeout}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConns,
+	}
+	return &backendClient{
+		httpClient: &http.Client{Transport: transport, Timeout: readTimeout},
+		limiter:    rate.NewLimiter(rate.Limit(qps), burst),
+		maxRetries: 3,
+	}
+}
+
+// fetchTile fetches a tile of entries from the backend, retrying retryable failures with
+// exponential backoff and jitter up to bc.maxRetries times.
+//
+// If the backend returns a non-200, non-retryable status code, it returns a
+// statusCodeError, so the caller can handle that case specially by propagating the
+// backend's status code (for instance, 400 or 404).
+func (bc *backendClient) fetchTile(ctx context.Context, t tile, m *metrics) (*entries, error) {
+	var lastErr error
+	for attempt := 0; attempt <= bc.maxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleepBackoff(ctx, attempt); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := bc.limiter.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("waiting for backend rate limiter: %w", err)
+		}
+
+		e, retryable, err := bc.fetchOnce(ctx, t, m)
+		if err == nil {
+			return e, nil
+		}
+		lastErr = err
+		if !retryable {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("backend request failed after %d retries: %w", bc.maxRetries, lastErr)
+}
+
+// sleepBackoff sleeps for an exponentially increasing, jittered duration based on
+// attempt (the 1-indexed retry number), returning early if ctx is done.
+func sleepBackoff(ctx context.Context, attempt int) error {
+	base := time.Duration(1<<uint(attempt-1)) * 100 * time.Millisecond
+	jittered := base/2 + time.Duration(rand.Int63n(int64(base)/2+1))
+	select {
+	case <-time.After(jittered):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetchOnce makes a single attempt at fetching t from the backend. It reports whether
+// the error it returns, if any, is worth retrying.
+func (bc *backendClient) fetchOnce(ctx context.Context, t tile, m *metrics) (*entries, bool, error) {
+	url := t.url()
+	labels := prometheus.Labels{"log_url": t.logURL, "tile_size": strconv.FormatInt(t.size, 10)}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to create backend Request object: %w", err)
+	}
+
+	start := time.Now()
+	resp, err := bc.httpClient.Do(r)
+	m.backendLatency.With(labels).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, true, fmt.Errorf("fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	m.backendStatuses.With(prometheus.Labels{
+		"log_url":     t.logURL,
+		"tile_size":   strconv.FormatInt(t.size, 10),
+		"status_code": strconv.Itoa(resp.StatusCode),
+	}).Inc()
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, true, fmt.Errorf("reading body from %s: %w", url, err)
+		}
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return nil, retryable, statusCodeError{resp.StatusCode, body}
+	}
+
+	var e entries
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		return nil, false, fmt.Errorf("reading body from %s: %w", url, err)
+	}
+
+	if len(e.Entries) > int(t.size) || len(e.Entries) == 0 {
+		return nil, false, fmt.Errorf("expected %d entries, got %d", t.size, len(e.Entries))
+	}
+
+	return &e, false, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"compress/gzip"
+	"container/list"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// tileCache stores and retrieves completed tiles. get returns a noSuchKey error if the
+// tile isn't present. Implementations must be safe for concurrent use.
+type tileCache interface {
+	get(ctx context.Context, t tile) (*entries, error)
+	put(ctx context.Context, t tile, e *entries) error
+}
+
+// tieredCache composes a fast local disk cache in front of a slower, durable S3 cache.
+// get checks disk first, falling back to s3 and writing through to disk on an s3 hit.
+// put always writes to s3 first, since s3 is the source of truth, then writes through
+// to disk on a best-effort basis: a disk write failure doesn't fail the request, since
+// the tile is already durably stored in s3.
+type tieredCache struct {
+	disk tileCache
+	s3   tileCache
+}
+
+func (tc *tieredCache) get(ctx context.Context, t tile) (*entries, error) {
+	if e, err := tc.disk.get(ctx, t); err == nil {
+		return e, nil
+	}
+
+	e, err := tc.s3.get(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tc.disk.put(ctx, t, e); err != nil {
+		log.Printf("writing through to disk cache for tile %v: %s", t, err)
+	}
+	return e, nil
+}
+
+func (tc *tieredCache) put(ctx context.Context, t tile, e *entries) error {
+	if err := tc.s3.put(ctx, t, e); err != nil {
+		return err
+	}
+	if err := tc.disk.put(ctx, t, e); err != nil {
+		log.Printf("writing through to disk cache for tile %v: %s", t, err)
+	}
+	return nil
+}
+
+// diskCacheEntry tracks one file in the disk cache's LRU index.
+type diskCacheEntry struct {
+	relPath string
+	size    int64
+}
+
+// diskCache is a tileCache backed by the local filesystem, bounded to maxBytes by
+// evicting the least-recently-used tiles. Tiles are sharded across subdirectories
+// keyed by a hash of the tile so that no single directory grows too large.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	lru     *list.List // front = most recently used
+	index   map[string]*list.Element
+	curSize int64
+}
+
+// newDiskCache returns a diskCache rooted at dir, bounded to maxBytes, populating its
+// LRU index from whatever is already on disk, and starts its background eviction loop.
+func newDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	dc := &diskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		index:    make(map[string]*list.Element),
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating local cache dir %q: %w", dir, err)
+	}
+	if err := dc.scan(); err != nil {
+		return nil, fmt.Errorf("scanning local cache dir %q: %w", dir, err)
+	}
+	go dc.evictLoop()
+	return dc, nil
+}
+
+// scan walks dir, populating the LRU index with whatever tiles are already cached
+// on disk from a previous run. Access order is unknown at startup, so entries are
+// indexed in the order they're found.
+func (dc *diskCache) scan() error {
+	return filepath.WalkDir(dc.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dc.dir, path)
+		if err != nil {
+			return err
+		}
+		dc.touch(relPath, info.Size())
+		return nil
+	})
+}
+
+// shardedPath returns the path, relative to dc.dir, that t is stored under:
+// tile_size=<size>/<xx>/<yy>/<logHash>-<start>.cbor.gz. xx/yy are derived from a hash
+// of the tile so tiles are spread evenly across subdirectories regardless of how
+// t.start is distributed. The filename is prefixed with a hash of t.logURL, since one
+// diskCache may be shared by several logs and t.start alone isn't unique across them.
+func shardedPath(t tile) string {
+	logHash := fnv.New32a()
+	io.WriteString(logHash, t.logURL)
+	logSum := logHash.Sum32()
+
+	shardHash := fnv.New32a()
+	fmt.Fprintf(shardHash, "%d/%d", logSum, t.start)
+	shardSum := shardHash.Sum32()
+
+	return filepath.Join(
+		fmt.Sprintf("tile_size=%d", t.size),
+		fmt.Sprintf("%02x", byte(shardSum>>8)),
+		fmt.Sprintf("%02x", byte(shardSum)),
+		fmt.Sprintf("%08x-%d.cbor.gz", logSum, t.start),
+	)
+}
+
+func (dc *diskCache) get(ctx context.Context, t tile) (*entries, error) {
+	relPath := shardedPath(t)
+	f, err := os.Open(filepath.Join(dc.dir, relPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, noSuchKey{}
+		}
+		return nil, fmt.Errorf("opening local cache file for tile %v: %w", t, err)
+	}
+	defer f.Close()
+
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("making gzipReader for tile %v: %w", t, err)
+	}
+	var e entries
+	if err := cbor.NewDecoder(gzipReader).Decode(&e); err != nil {
+		return nil, fmt.Errorf("decoding local cache file for tile %v: %w", t, err)
+	}
+
+	dc.markUsed(relPath)
+	return &e, nil
+}
+
+func (dc *diskCache) put(ctx context.Context, t tile, e *entries) error {
+	relPath := shardedPath(t)
+	fullPath := filepath.Join(dc.dir, relPath)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+		return fmt.Errorf("making local cache dir for tile %v: %w", t, err)
+	}
+
+	// Write to a uniquely-named temp file and rename into place, so a concurrent get
+	// never observes a partially-written tile and concurrent writers of the same tile
+	// never share (and corrupt) each other's temp file.
+	f, err := os.CreateTemp(filepath.Dir(fullPath), filepath.Base(fullPath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating local cache temp file for tile %v: %w", t, err)
+	}
+	tmpPath := f.Name()
+	gzipWriter := gzip.NewWriter(f)
+	if err := cbor.NewEncoder(gzipWriter).Encode(e); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("encoding tile %v to local cache: %w", t, err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("closing gzip writer for tile %v: %w", t, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("closing local cache file for tile %v: %w", t, err)
+	}
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("statting local cache file for tile %v: %w", t, err)
+	}
+	if err := os.Rename(tmpPath, fullPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("renaming local cache file for tile %v into place: %w", t, err)
+	}
+
+	dc.touch(relPath, info.Size())
+	return nil
+}
+
+// touch records relPath in the LRU index as most-recently-used, updating curSize if
+// its size changed.
+func (dc *diskCache) touch(relPath string, size int64) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if el, ok := dc.index[relPath]; ok {
+		existing := el.Value.(*diskCacheEntry)
+		dc.curSize += size - existing.size
+		existing.size = size
+		dc.lru.MoveToFront(el)
+		return
+	}
+	el := dc.lru.PushFront(&diskCacheEntry{relPath: relPath, size: size})
+	dc.index[relPath] = el
+	dc.curSize += size
+}
+
+// markUsed moves relPath to the front of the LRU without changing its recorded size.
+func (dc *diskCache) markUsed(relPath string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if el, ok := dc.index[relPath]; ok {
+		dc.lru.MoveToFront(el)
+	}
+}
+
+// evictLoop periodically evicts the least-recently-used tiles until the cache is back
+// under its byte budget.
+func (dc *diskCache) evictLoop() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		dc.evictOnce()
+	}
+}
+
+func (dc *diskCache) evictOnce() {
+	for {
+		dc.mu.Lock()
+		if dc.curSize <= dc.maxBytes {
+			dc.mu.Unlock()
+			return
+		}
+		el := dc.lru.Back()
+		if el == nil {
+			dc.mu.Unlock()
+			return
+		}
+		victim := el.Value.(*diskCacheEntry)
+		dc.lru.Remove(el)
+		delete(dc.index, victim.relPath)
+		dc.curSize -= victim.size
+		dc.mu.Unlock()
+
+		if err := os.Remove(filepath.Join(dc.dir, victim.relPath)); err != nil && !os.IsNotExist(err) {
+			log.Printf("evicting local cache file %q: %s", victim.relPath, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func testEntries(n byte) *entries {
+	return &entries{Entries: []entry{{LeafInput: []byte{n}, ExtraData: []byte{n, n}}}}
+}
+
+func TestDiskCachePutGetRoundTrip(t *testing.T) {
+	dc, err := newDiskCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatalf("newDiskCache: %s", err)
+	}
+	ctx := context.Background()
+	tl := tile{start: 0, end: 4, size: 4, logURL: "https://log.example.com"}
+	want := testEntries(1)
+
+	if err := dc.put(ctx, tl, want); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	got, err := dc.get(ctx, tl)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("get = %+v, want %+v", got, want)
+	}
+}
+
+func TestDiskCacheGetMissing(t *testing.T) {
+	dc, err := newDiskCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatalf("newDiskCache: %s", err)
+	}
+	tl := tile{start: 0, end: 4, size: 4, logURL: "https://log.example.com"}
+	_, err = dc.get(context.Background(), tl)
+	if !errors.Is(err, noSuchKey{}) {
+		t.Fatalf("get on empty cache: err = %v, want noSuchKey", err)
+	}
+}
+
+// TestDiskCacheEvictionOrder checks that evictOnce removes the least-recently-used
+// tile first, and that a get refreshes a tile's recency.
+func TestDiskCacheEvictionOrder(t *testing.T) {
+	dc, err := newDiskCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatalf("newDiskCache: %s", err)
+	}
+	ctx := context.Background()
+	tiles := make([]tile, 3)
+	for i := range tiles {
+		tiles[i] = tile{start: int64(i) * 4, end: int64(i)*4 + 4, size: 4, logURL: "https://log.example.com"}
+		if err := dc.put(ctx, tiles[i], testEntries(byte(i))); err != nil {
+			t.Fatalf("put %d: %s", i, err)
+		}
+	}
+
+	// Touch tiles[0] so it's most-recently-used, leaving tiles[1] as the
+	// least-recently-used entry.
+	if _, err := dc.get(ctx, tiles[0]); err != nil {
+		t.Fatalf("get tiles[0]: %s", err)
+	}
+
+	// Shrink the budget so eviction must remove exactly one tile.
+	dc.mu.Lock()
+	dc.maxBytes = dc.curSize - 1
+	dc.mu.Unlock()
+	dc.evictOnce()
+
+	if _, err := dc.get(ctx, tiles[1]); !errors.Is(err, noSuchKey{}) {
+		t.Errorf("tiles[1] (least-recently-used) should have been evicted, got err = %v", err)
+	}
+	if _, err := dc.get(ctx, tiles[0]); err != nil {
+		t.Errorf("tiles[0] (recently touched) should still be cached, got err = %v", err)
+	}
+	if _, err := dc.get(ctx, tiles[2]); err != nil {
+		t.Errorf("tiles[2] (recently written) should still be cached, got err = %v", err)
+	}
+}
+
+// TestDiskCachePutConcurrentSameKey exercises concurrent writers of the same tile,
+// which put's unique per-call temp file name (rather than a single fixed one) exists
+// to make safe: every writer must complete with a readable, uncorrupted tile.
+func TestDiskCachePutConcurrentSameKey(t *testing.T) {
+	dc, err := newDiskCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatalf("newDiskCache: %s", err)
+	}
+	ctx := context.Background()
+	tl := tile{start: 0, end: 4, size: 4, logURL: "https://log.example.com"}
+
+	const writers = 16
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := dc.put(ctx, tl, testEntries(byte(i))); err != nil {
+				t.Errorf("put %d: %s", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	got, err := dc.get(ctx, tl)
+	if err != nil {
+		t.Fatalf("get after concurrent puts: %s", err)
+	}
+	if len(got.Entries) != 1 || len(got.Entries[0].LeafInput) != 1 || len(got.Entries[0].ExtraData) != 2 {
+		t.Errorf("get after concurrent puts returned corrupted entries: %+v", got)
+	}
+}
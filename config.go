@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// logConfig describes one CT log that ctile should front: where to route incoming
+// requests for it, where its backend lives, and where its cache lives in S3.
+type logConfig struct {
+	// PathPrefix is matched against the incoming request path to select this log.
+	// For example, "/oak2024" routes "/oak2024/ct/v1/get-entries" here. Must not be empty
+	// in a config file; the single-log flags leave it empty, which matches every path.
+	PathPrefix string `json:"path_prefix" yaml:"path_prefix"`
+
+	// LogURL is the CT log URL, e.g. "https://oak.ct.letsencrypt.org/2024". Must not be empty.
+	LogURL string `json:"log_url" yaml:"log_url"`
+
+	// TileSize is the CT tile size used by this log's backend. Must not be zero.
+	TileSize int `json:"tile_size" yaml:"tile_size"`
+
+	// S3Bucket is the S3 bucket to use for caching this log's tiles. Must not be empty.
+	S3Bucket string `json:"s3_bucket" yaml:"s3_bucket"`
+
+	// S3Prefix is the prefix to add to the path when caching this log's tiles in S3.
+	// Defaults to LogURL if empty.
+	S3Prefix string `json:"s3_prefix" yaml:"s3_prefix"`
+}
+
+// validate returns an error describing the first missing or invalid required field, if any.
+func (lc *logConfig) validate() error {
+	if lc.PathPrefix == "" {
+		return fmt.Errorf("missing path_prefix")
+	}
+	if lc.LogURL == "" {
+		return fmt.Errorf("missing log_url for path_prefix %q", lc.PathPrefix)
+	}
+	if lc.TileSize == 0 {
+		return fmt.Errorf("missing tile_size for path_prefix %q", lc.PathPrefix)
+	}
+	if lc.S3Bucket == "" {
+		return fmt.Errorf("missing s3_bucket for path_prefix %q", lc.PathPrefix)
+	}
+	return nil
+}
+
+// loadConfig reads and parses a multi-log config file. The format (YAML or JSON) is chosen
+// by the file's extension: ".json" is parsed as JSON, anything else as YAML.
+func loadConfig(path string) ([]logConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file %q: %w", path, err)
+	}
+
+	var logs []logConfig
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(data, &logs)
+	} else {
+		err = yaml.Unmarshal(data, &logs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing config file %q: %w", path, err)
+	}
+
+	if len(logs) == 0 {
+		return nil, fmt.Errorf("config file %q describes no logs", path)
+	}
+	seenPrefixes := make(map[string]bool, len(logs))
+	for i := range logs {
+		lc := &logs[i]
+		if err := lc.validate(); err != nil {
+			return nil, err
+		}
+		if seenPrefixes[lc.PathPrefix] {
+			return nil, fmt.Errorf("duplicate path_prefix %q", lc.PathPrefix)
+		}
+		seenPrefixes[lc.PathPrefix] = true
+		if lc.S3Prefix == "" {
+			lc.S3Prefix = lc.LogURL
+		}
+	}
+	return logs, nil
+}
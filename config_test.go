@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("writing test config %q: %s", path, err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		wantErr  string
+		want     []logConfig
+	}{
+		{
+			name: "valid yaml",
+			file: "config.yaml",
+			contents: `
+- path_prefix: /oak2024
+  log_url: https://oak.ct.example.com/2024
+  tile_size: 256
+  s3_bucket: ct-tiles
+- path_prefix: /oak2025
+  log_url: https://oak.ct.example.com/2025
+  tile_size: 256
+  s3_bucket: ct-tiles
+  s3_prefix: custom-prefix
+`,
+			want: []logConfig{
+				{
+					PathPrefix: "/oak2024",
+					LogURL:     "https://oak.ct.example.com/2024",
+					TileSize:   256,
+					S3Bucket:   "ct-tiles",
+					S3Prefix:   "https://oak.ct.example.com/2024",
+				},
+				{
+					PathPrefix: "/oak2025",
+					LogURL:     "https://oak.ct.example.com/2025",
+					TileSize:   256,
+					S3Bucket:   "ct-tiles",
+					S3Prefix:   "custom-prefix",
+				},
+			},
+		},
+		{
+			name: "valid json",
+			file: "config.json",
+			contents: `[
+				{"path_prefix": "/oak2024", "log_url": "https://oak.ct.example.com/2024", "tile_size": 256, "s3_bucket": "ct-tiles"}
+			]`,
+			want: []logConfig{
+				{
+					PathPrefix: "/oak2024",
+					LogURL:     "https://oak.ct.example.com/2024",
+					TileSize:   256,
+					S3Bucket:   "ct-tiles",
+					S3Prefix:   "https://oak.ct.example.com/2024",
+				},
+			},
+		},
+		{
+			name:     "missing field",
+			file:     "config.yaml",
+			contents: `- path_prefix: /oak2024`,
+			wantErr:  `missing log_url for path_prefix "/oak2024"`,
+		},
+		{
+			name: "duplicate path_prefix",
+			file: "config.yaml",
+			contents: `
+- path_prefix: /oak2024
+  log_url: https://oak.ct.example.com/2024
+  tile_size: 256
+  s3_bucket: ct-tiles
+- path_prefix: /oak2024
+  log_url: https://oak.ct.example.com/2025
+  tile_size: 256
+  s3_bucket: ct-tiles
+`,
+			wantErr: `duplicate path_prefix "/oak2024"`,
+		},
+		{
+			name:     "empty",
+			file:     "config.yaml",
+			contents: `[]`,
+			wantErr:  "describes no logs",
+		},
+		{
+			name:     "malformed json",
+			file:     "config.json",
+			contents: `not json`,
+			wantErr:  "parsing config file",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeConfigFile(t, tc.file, tc.contents)
+			got, err := loadConfig(path)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("loadConfig(%q) error = %v, want containing %q", path, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig(%q) unexpected error: %s", path, err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("loadConfig(%q) = %d logs, want %d", path, len(got), len(tc.want))
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("loadConfig(%q)[%d] = %+v, want %+v", path, i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
@@ -2,17 +2,15 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -20,8 +18,8 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	"github.com/fxamacker/cbor/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
 )
 
 // parseQueryParams returns the start and end values, or an error.
@@ -118,73 +116,6 @@ func (s statusCodeError) Error() string {
 	return fmt.Sprintf("backend responded with status code %d and body:\n%s", s.statusCode, string(s.body))
 }
 
-// getTileFromBackend fetches a tile of entries from the backend.
-//
-// If the backend returns a non-200 status code, it returns a statusCodeError,
-// so the caller can handle that case specially by propagating the backend's
-// status code (for instance, 400 or 404).
-func getTileFromBackend(ctx context.Context, t tile) (*entries, error) {
-	url := t.url()
-	r, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create backend Request object: %w", err)
-	}
-	resp, err := http.DefaultClient.Do(r)
-	if err != nil {
-		return nil, fmt.Errorf("fetching %s: %w", url, err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("reading body from %s: %w", url, err)
-		}
-		return nil, statusCodeError{resp.StatusCode, body}
-	}
-
-	var entries entries
-	err = json.NewDecoder(resp.Body).Decode(&entries)
-	if err != nil {
-		return nil, fmt.Errorf("reading body from %s: %w", url, err)
-	}
-
-	if len(entries.Entries) > int(t.size) || len(entries.Entries) == 0 {
-		return nil, fmt.Errorf("expected %d entries, got %d", t.size, len(entries.Entries))
-	}
-
-	return &entries, nil
-}
-
-// writeToS3 stores the entries corresponding to the given tile in s3.
-func (tch *tileCachingHandler) writeToS3(ctx context.Context, t tile, e *entries) error {
-	if len(e.Entries) != int(t.size) || t.end != t.start+t.size {
-		return fmt.Errorf("internal inconsistency: len(entries) == %d; tile = %v", len(e.Entries), t)
-	}
-
-	var body bytes.Buffer
-	w := gzip.NewWriter(&body)
-	err := cbor.NewEncoder(w).Encode(e)
-	if err != nil {
-		return nil
-	}
-
-	err = w.Close()
-	if err != nil {
-		return fmt.Errorf("closing gzip writer: %w", err)
-	}
-
-	key := tch.s3Prefix + t.key()
-	_, err = tch.s3Service.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(tch.s3Bucket),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(body.Bytes()),
-	})
-	if err != nil {
-		return fmt.Errorf("putting in bucket %q with key %q: %s", tch.s3Bucket, key, err)
-	}
-	return nil
-}
-
 // noSuchKey indicates the requested key does not exist.
 type noSuchKey struct{}
 
@@ -192,51 +123,87 @@ func (noSuchKey) Error() string {
 	return "no such key"
 }
 
-// getFromS3 retrieves the entries corresponding to the given tile from s3.
-// If the tile isn't already stored in s3, it returns a noSuchKey error.
-func (tch *tileCachingHandler) getFromS3(ctx context.Context, t tile) (*entries, error) {
-	key := tch.s3Prefix + t.key()
-	resp, err := tch.s3Service.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(tch.s3Bucket),
-		Key:    aws.String(key),
-	})
-	if err != nil {
-		var nsk *types.NoSuchKey
-		if errors.As(err, &nsk) {
-			return nil, noSuchKey{}
-		}
-		return nil, fmt.Errorf("getting from bucket %q with key %q: %w", tch.s3Bucket, key, err)
-	}
-
-	var entries entries
-	gzipReader, err := gzip.NewReader(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("making gzipReader: %w", err)
-	}
-	err = cbor.NewDecoder(gzipReader).Decode(&entries)
-	if err != nil {
-		return nil, fmt.Errorf("reading body from bucket %q with key %q: %w", tch.s3Bucket, key, err)
-	}
-
-	if len(entries.Entries) != int(t.size) || t.end != t.start+t.size {
-		return nil, fmt.Errorf("internal inconsistency: len(entries) == %d; tile = %v", len(entries.Entries), t)
-	}
+// cloneEntries returns a copy of e whose Entries slice has its own backing array.
+// Callers that receive a result shared via singleflight must clone it before truncating,
+// since truncation reslices Entries and would otherwise race with other waiters doing
+// the same against the same backing array.
+func cloneEntries(e *entries) *entries {
+	clone := entries{Entries: make([]entry, len(e.Entries))}
+	copy(clone.Entries, e.Entries)
+	return &clone
+}
 
-	return &entries, nil
+// backendFetchResult is the value shared by backendGroup.Do among goroutines coalesced
+// onto the same backend fetch + cache write.
+type backendFetchResult struct {
+	contents *entries
+	partial  bool // true if the backend returned fewer than tileSize entries, meaning the tile wasn't written to the cache.
 }
 
-// tileCachingHandler is the main HTTP handler that serves CT tiles it fetches
-// from a backend server and from the cache tiles it maintains in S3.
+// tileCachingHandler is the HTTP handler that serves CT tiles for a single log,
+// fetching them from that log's backend and from the cache tiles it maintains in S3.
 type tileCachingHandler struct {
-	logURL   string // The string form of the HTTP host and path prefix to add incoming request paths to in order to fetch tiles from the backing CT log. Must not be empty.
-	tileSize int    // The CT tile size used here and in the given backend. Must not be zero.
+	pathPrefix string // The incoming request path prefix routed to this log by the router. May be empty when there's only one configured log.
+	logURL     string // The string form of the HTTP host and path prefix to add incoming request paths to in order to fetch tiles from the backing CT log. Must not be empty.
+	tileSize   int    // The CT tile size used here and in the given backend. Must not be zero.
+
+	cache   tileCache      // Where completed tiles are read from and written to. Must not be nil.
+	backend *backendClient // Used to fetch tiles from the log's backend. Must not be nil.
+
+	metrics *metrics // The collectors to record cache and backend observations into. Must not be nil.
+
+	// cacheGroup and backendGroup coalesce concurrent requests for the same tile so that a
+	// stampede of clients asking for an overlapping, not-yet-cached range causes only one
+	// cache read, and one backend fetch + cache write, rather than one per request.
+	// Both are keyed by tile.key(). Their zero values are ready to use.
+	//
+	// The closure run by Do is shared by every coalesced caller, so it must not run on any
+	// one of their request contexts: if the caller that happened to become the singleflight
+	// leader disconnects or times out, singleflight would deliver that same cancellation
+	// error to every other, still-live, caller waiting on the same tile. groupTimeout bounds
+	// a context.Background()-derived context used for the closure instead.
+	cacheGroup   singleflight.Group
+	backendGroup singleflight.Group
+	groupTimeout time.Duration // Max time ServeHTTP spends in a cacheGroup/backendGroup Do closure; prefetch closures run on the prefetcher's own context instead. Must not be zero.
+
+	prefetch *prefetcher // Optional. If non-nil, warms the cache for tiles likely to be requested next. May be nil.
+}
 
-	s3Service *s3.Client // The S3 service to use for caching tiles. Must not be nil.
-	s3Prefix  string     // The prefix to add to the path when caching tiles in S3. Must not be empty.
-	s3Bucket  string     // The S3 bucket to use for caching tiles. Must not be empty.
+// fetchAndCacheTile fetches t from the backend, coalescing concurrent callers for the
+// same tile via backendGroup, and writes it to the cache unless it's a partial tile
+// (the backend hasn't produced tileSize entries for this range yet, which happens at
+// the end of the log). It's used both to serve a live cache miss and, by prefetcher,
+// to warm tiles nobody has asked for yet.
+func (tch *tileCachingHandler) fetchAndCacheTile(ctx context.Context, t tile) (backendFetchResult, error) {
+	fetched, err, _ := tch.backendGroup.Do(t.key(), func() (interface{}, error) {
+		contents, err := tch.backend.fetchTile(ctx, t, tch.metrics)
+		if err != nil {
+			return nil, err
+		}
+
+		partial := len(contents.Entries) != tch.tileSize
+		if !partial {
+			if err := tch.cache.put(ctx, t, contents); err != nil {
+				return nil, err
+			}
+		}
+		return backendFetchResult{contents: contents, partial: partial}, nil
+	})
+	if err != nil {
+		return backendFetchResult{}, err
+	}
+	return fetched.(backendFetchResult), nil
 }
 
 func (tch *tileCachingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestStart := time.Now()
+	tileSizeLabel := strconv.Itoa(tch.tileSize)
+	defer func() {
+		tch.metrics.requestLatency.With(prometheus.Labels{
+			"log_url": tch.logURL, "tile_size": tileSizeLabel,
+		}).Observe(time.Since(requestStart).Seconds())
+	}()
+
 	if !strings.HasSuffix(r.URL.Path, "/ct/v1/get-entries") {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "invalid path %q\n", r.URL.Path)
@@ -252,40 +219,51 @@ func (tch *tileCachingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 
 	tile := makeTile(start, int64(tch.tileSize), tch.logURL)
 
-	contents, err := tch.getFromS3(r.Context(), tile)
+	// groupCtx, not r.Context(), backs the cacheGroup/backendGroup Do closures below:
+	// whichever caller becomes the singleflight leader for this tile runs the closure on
+	// behalf of every coalesced caller, so it must not be canceled just because the leader's
+	// own request disconnects or hits http.TimeoutHandler's deadline.
+	groupCtx, cancel := context.WithTimeout(context.Background(), tch.groupTimeout)
+	defer cancel()
+
+	cacheResult, err, _ := tch.cacheGroup.Do(tile.key(), func() (interface{}, error) {
+		return tch.cache.get(groupCtx, tile)
+	})
+	var contents *entries
 	if err != nil && !errors.Is(err, noSuchKey{}) {
 		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "reading from s3: %s\n", err)
+		fmt.Fprintf(w, "reading from cache: %s\n", err)
 		return
 	} else if errors.Is(err, noSuchKey{}) {
-		contents, err = getTileFromBackend(r.Context(), tile)
+		tch.metrics.cacheMisses.With(prometheus.Labels{"log_url": tch.logURL, "tile_size": tileSizeLabel}).Inc()
+
+		result, err := tch.fetchAndCacheTile(groupCtx, tile)
 		if err != nil {
-			status := http.StatusInternalServerError
 			var statusCodeErr statusCodeError
 			if errors.As(err, &statusCodeErr) {
-				status = statusCodeErr.statusCode
+				w.WriteHeader(statusCodeErr.statusCode)
+				fmt.Fprintln(w, err)
+				return
 			}
-			w.WriteHeader(status)
-			fmt.Fprintln(w, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "fetching tile: %s\n", err)
 			return
 		}
 
-		// If we got a partial tile, assume we are at the end of the log and the last
-		// tile isn't filled up yet. In that case, don't write to S3, but still return
-		// results to the user.
-		if len(contents.Entries) == tch.tileSize {
-			err := tch.writeToS3(r.Context(), tile, contents)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "writing to s3: %s\n", err)
-				return
-			}
-		} else {
+		contents = cloneEntries(result.contents)
+		if result.partial {
+			tch.metrics.cachePartials.With(prometheus.Labels{"log_url": tch.logURL, "tile_size": tileSizeLabel}).Inc()
 			w.Header().Set("X-Partial-Tile", "true")
+		} else if tch.prefetch != nil {
+			// Run on a context decoupled from this request's, since http.TimeoutHandler
+			// cancels the request's context once the response is written.
+			tch.prefetch.prefetchAfter(context.Background(), tile)
 		}
 
 		w.Header().Set("X-Source", "CT log")
 	} else {
+		tch.metrics.cacheHits.With(prometheus.Labels{"log_url": tch.logURL, "tile_size": tileSizeLabel}).Inc()
+		contents = cloneEntries(cacheResult.(*entries))
 		w.Header().Set("X-Source", "S3")
 	}
 
@@ -320,51 +298,165 @@ func (tch *tileCachingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	encoder.Encode(contents)
 }
 
+// router dispatches an incoming request to the tileCachingHandler for whichever
+// configured log's pathPrefix is the longest match for the request path. This lets
+// one ctile instance front an operator's entire set of CT logs, each with its own
+// backend, tile size, and S3 bucket/prefix.
+type router struct {
+	handlers []*tileCachingHandler // sorted by descending len(pathPrefix), so the first match found is the longest.
+}
+
+// newRouter returns a router over handlers, matching longest pathPrefix first.
+func newRouter(handlers []*tileCachingHandler) *router {
+	sorted := make([]*tileCachingHandler, len(handlers))
+	copy(sorted, handlers)
+	sort.Slice(sorted, func(i, j int) bool {
+		return len(sorted[i].pathPrefix) > len(sorted[j].pathPrefix)
+	})
+	return &router{handlers: sorted}
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, h := range rt.handlers {
+		if strings.HasPrefix(r.URL.Path, h.pathPrefix) {
+			h.ServeHTTP(w, r)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, "no configured log matches path %q\n", r.URL.Path)
+}
+
 func main() {
 	logURL := flag.String("log-url", "", "CT log URL. e.g. https://oak.ct.letsencrypt.org/2023")
 	tileSize := flag.Int("tile-size", 0, "tile size. Must match the value used by the backend")
 	s3bucket := flag.String("s3-bucket", "", "s3 bucket to use for caching")
 	s3prefix := flag.String("s3-prefix", "", "prefix for s3 keys. defaults to value of -backend")
+	configPath := flag.String("config", "", "path to a YAML or JSON file describing multiple logs to front, each with its own path prefix, backend, tile size, and S3 bucket/prefix. When set, -log-url, -tile-size, -s3-bucket, and -s3-prefix are ignored")
+	s3Endpoint := flag.String("s3-endpoint", "", "custom S3-compatible endpoint to use instead of AWS, e.g. for MinIO, Ceph RGW, R2, or GCS's S3 gateway")
+	s3Region := flag.String("s3-region", "", "region to use for S3 requests. Defaults to the region from the environment/shared config")
+	s3ForcePathStyle := flag.Bool("s3-force-path-style", false, "use path-style S3 requests (bucket.s3.amazonaws.com/key becomes s3.amazonaws.com/bucket/key). Required by some S3-compatible services")
+	s3StorageClass := flag.String("s3-storage-class", "", "S3 storage class to use when writing tiles, e.g. STANDARD_IA or INTELLIGENT_TIERING. Defaults to the bucket's default storage class")
+	s3SSE := flag.String("s3-sse", "", "server-side encryption mode to use when writing tiles, e.g. AES256 or aws:kms. Defaults to none")
+	localCacheDir := flag.String("local-cache-dir", "", "directory for an optional on-disk cache that sits in front of S3. If unset, S3 is read and written directly")
+	localCacheBytes := flag.Int64("local-cache-bytes", 0, "byte budget for -local-cache-dir; the least-recently-used tiles are evicted once it's exceeded. Required if -local-cache-dir is set")
+	prefetchAhead := flag.Int("prefetch-ahead", 0, "number of tiles past a cache miss to eagerly prefetch in the background. 0 disables prefetching")
+	prefetchWorkers := flag.Int("prefetch-workers", 4, "max number of concurrent prefetch fetches per log")
+	sthPollInterval := flag.Duration("sth-poll-interval", 0, "how often to poll each log's get-sth endpoint and prefetch newly-complete tiles at the tree head. 0 disables polling")
+	backendConnectTimeout := flag.Duration("backend-connect-timeout", 2*time.Second, "max time to spend establishing a connection to the backend")
+	backendReadTimeout := flag.Duration("backend-read-timeout", 10*time.Second, "max time to spend on a single backend request, including connecting and reading the response")
+	backendMaxIdleConns := flag.Int("backend-max-idle-conns", 100, "max idle connections to keep open per backend")
+	backendQPS := flag.Float64("backend-qps", 50, "max requests per second to send to each log's backend")
+	backendBurst := flag.Int("backend-burst", 10, "max burst size above -backend-qps allowed when sending requests to each log's backend")
 	listenAddress := flag.String("listen-address", ":8080", "address to listen on")
+	metricsAddress := flag.String("metrics-address", ":8081", "address to serve /metrics on. This is a separate listener from -listen-address so metrics scraping is isolated from CT traffic")
 
 	// fullRequestTimeout is the max allowed time the handler can read from S3 and return or read from S3, read from backend, write to S3, and return.
 	fullRequestTimeout := flag.Duration("full-request-timeout", 4*time.Second, "max time to spend in the HTTP handler")
 
 	flag.Parse()
 
-	if *logURL == "" {
-		log.Fatal("missing required flag: -log-url")
-	}
-
-	if *s3bucket == "" {
-		log.Fatal("missing required flag: -s3-bucket")
+	if *fullRequestTimeout == 0 {
+		log.Fatal("-full-request-timeout may not have a timeout value of 0")
 	}
 
-	if *tileSize == 0 {
-		log.Fatal("missing required flag: -tile-size")
+	if *localCacheDir != "" && *localCacheBytes == 0 {
+		log.Fatal("-local-cache-bytes is required when -local-cache-dir is set")
 	}
 
-	if *fullRequestTimeout == 0 {
-		log.Fatal("-full-request-timeout may not have a timeout value of 0")
+	var logs []logConfig
+	if *configPath != "" {
+		var err error
+		logs, err = loadConfig(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if *logURL == "" {
+			log.Fatal("missing required flag: -log-url")
+		}
+		if *s3bucket == "" {
+			log.Fatal("missing required flag: -s3-bucket")
+		}
+		if *tileSize == 0 {
+			log.Fatal("missing required flag: -tile-size")
+		}
+		if *s3prefix == "" {
+			*s3prefix = *logURL
+		}
+		logs = []logConfig{{
+			LogURL:   *logURL,
+			TileSize: *tileSize,
+			S3Bucket: *s3bucket,
+			S3Prefix: *s3prefix,
+		}}
 	}
 
-	if *s3prefix == "" {
-		*s3prefix = *logURL
+	var configOpts []func(*config.LoadOptions) error
+	if *s3Region != "" {
+		configOpts = append(configOpts, config.WithRegion(*s3Region))
 	}
-
-	cfg, err := config.LoadDefaultConfig(context.Background())
+	awsCfg, err := config.LoadDefaultConfig(context.Background(), configOpts...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	svc := s3.NewFromConfig(cfg)
-
-	handler := &tileCachingHandler{
-		logURL:    *logURL,
-		tileSize:  *tileSize,
-		s3Service: svc,
-		s3Prefix:  *s3prefix,
-		s3Bucket:  *s3bucket,
+	svc := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		o.UsePathStyle = *s3ForcePathStyle
+		if *s3Endpoint != "" {
+			o.BaseEndpoint = aws.String(*s3Endpoint)
+		}
+	})
+
+	reg := prometheus.NewRegistry()
+	m := newMetrics(reg)
+
+	var disk *diskCache
+	if *localCacheDir != "" {
+		var err error
+		disk, err = newDiskCache(*localCacheDir, *localCacheBytes)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	handlers := make([]*tileCachingHandler, len(logs))
+	for i, lc := range logs {
+		s3c := &s3Cache{
+			service:      svc,
+			prefix:       lc.S3Prefix,
+			bucket:       lc.S3Bucket,
+			storageClass: *s3StorageClass,
+			sse:          *s3SSE,
+			metrics:      m,
+		}
+		var cache tileCache = s3c
+		if disk != nil {
+			cache = &tieredCache{disk: disk, s3: s3c}
+		}
+
+		handlers[i] = &tileCachingHandler{
+			pathPrefix:   lc.PathPrefix,
+			logURL:       lc.LogURL,
+			tileSize:     lc.TileSize,
+			cache:        cache,
+			backend:      newBackendClient(*backendConnectTimeout, *backendReadTimeout, *backendMaxIdleConns, *backendQPS, *backendBurst),
+			metrics:      m,
+			groupTimeout: *fullRequestTimeout,
+		}
+
+		if *prefetchAhead > 0 || *sthPollInterval > 0 {
+			p := newPrefetcher(handlers[i], *prefetchAhead, *prefetchWorkers)
+			handlers[i].prefetch = p
+			if *sthPollInterval > 0 {
+				go p.pollSTH(context.Background(), *sthPollInterval)
+			}
+		}
 	}
+	rt := newRouter(handlers)
+
+	go func() {
+		log.Fatal(serveMetrics(*metricsAddress, reg))
+	}()
 
 	srv := http.Server{
 		Addr:              *listenAddress,
@@ -372,7 +464,7 @@ func main() {
 		WriteTimeout:      *fullRequestTimeout + 1*time.Second, // must be a bit larger than than than the max time spent in the HTTP handler
 		IdleTimeout:       5 * time.Minute,
 		ReadHeaderTimeout: 2 * time.Second,
-		Handler:           http.TimeoutHandler(handler, *fullRequestTimeout, "full request timeout"),
+		Handler:           http.TimeoutHandler(rt, *fullRequestTimeout, "full request timeout"),
 	}
 
 	log.Fatal(srv.ListenAndServe())
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds all the Prometheus collectors ctile exposes. Every collector
+// is labeled by log_url and tile_size so that a single ctile instance fronting
+// several CT logs (or serving several tile sizes) produces distinguishable
+// series per log.
+type metrics struct {
+	s3GetLatency    *prometheus.HistogramVec
+	s3GetErrors     *prometheus.CounterVec
+	s3PutLatency    *prometheus.HistogramVec
+	s3PutErrors     *prometheus.CounterVec
+	backendLatency  *prometheus.HistogramVec
+	backendStatuses *prometheus.CounterVec
+	cacheHits       *prometheus.CounterVec
+	cacheMisses     *prometheus.CounterVec
+	cachePartials   *prometheus.CounterVec
+	requestLatency  *prometheus.HistogramVec
+}
+
+// newMetrics creates the ctile metric collectors and registers them with reg.
+func newMetrics(reg *prometheus.Registry) *metrics {
+	factory := promauto.With(reg)
+	labels := []string{"log_url", "tile_size"}
+	return &metrics{
+		s3GetLatency: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "ctile_s3_get_latency_seconds",
+			Help: "Latency of S3 GetObject calls made while reading cached tiles.",
+		}, labels),
+		s3GetErrors: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "ctile_s3_get_errors_total",
+			Help: "Count of S3 GetObject errors, split by whether the key was missing.",
+		}, append(labels, "error_type")),
+		s3PutLatency: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "ctile_s3_put_latency_seconds",
+			Help: "Latency of S3 PutObject calls made while writing tiles to the cache.",
+		}, labels),
+		s3PutErrors: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "ctile_s3_put_errors_total",
+			Help: "Count of S3 PutObject errors.",
+		}, labels),
+		backendLatency: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "ctile_backend_get_entries_latency_seconds",
+			Help: "Latency of get-entries requests made to the CT log backend.",
+		}, labels),
+		backendStatuses: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "ctile_backend_get_entries_status_total",
+			Help: "Count of get-entries responses from the CT log backend, by status code.",
+		}, append(labels, "status_code")),
+		cacheHits: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "ctile_cache_hits_total",
+			Help: "Count of requests served from the tile cache (local disk or S3).",
+		}, labels),
+		cacheMisses: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "ctile_cache_misses_total",
+			Help: "Count of requests that missed the tile cache (local disk and S3) and went to the backend.",
+		}, labels),
+		cachePartials: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "ctile_cache_partial_tiles_total",
+			Help: "Count of backend responses that were partial tiles and so weren't cached.",
+		}, labels),
+		requestLatency: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "ctile_request_latency_seconds",
+			Help: "End-to-end latency of ServeHTTP, from request in to response written.",
+		}, labels),
+	}
+}
+
+// serveMetrics starts a server exposing /metrics for reg on address. It is meant to
+// be run on its own listener, separate from the mux that serves CT traffic, so that
+// metrics scraping can't be affected by (and can't affect) tile serving.
+func serveMetrics(address string, reg *prometheus.Registry) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	return http.ListenAndServe(address, mux)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// sthResponse corresponds to the JSON response of the CT get-sth endpoint.
+// https://datatracker.ietf.org/doc/html/rfc6962#section-4.3
+type sthResponse struct {
+	TreeSize int64 `json:"tree_size"`
+}
+
+// prefetcher eagerly warms tch's cache: prefetchAfter fetches the tiles following one
+// just served from the backend, and pollSTH periodically polls the log's get-sth
+// endpoint to fill in newly-complete tiles at the tree head. Both go through
+// tch.cacheGroup and tch.fetchAndCacheTile, so they coalesce with any concurrent live
+// request for the same tile, and they never write a partial tile to the cache.
+//
+// All prefetch work is bounded by a worker pool, and run on a context supplied by the
+// caller rather than an incoming request's, since http.TimeoutHandler cancels a
+// request's context as soon as its response is written.
+type prefetcher struct {
+	tch     *tileCachingHandler
+	ahead   int
+	workers chan struct{} // buffered semaphore bounding concurrent prefetch fetches
+}
+
+// newPrefetcher returns a prefetcher for tch that fetches up to ahead tiles past a
+// served miss, running at most maxWorkers prefetch fetches concurrently.
+func newPrefetcher(tch *tileCachingHandler, ahead, maxWorkers int) *prefetcher {
+	return &prefetcher{tch: tch, ahead: ahead, workers: make(chan struct{}, maxWorkers)}
+}
+
+// prefetchAfter asynchronously fetches the tiles that follow served, up to p.ahead of
+// them, using ctx rather than the triggering request's context.
+func (p *prefetcher) prefetchAfter(ctx context.Context, served tile) {
+	for i := int64(1); i <= int64(p.ahead); i++ {
+		t := makeTile(served.start+i*served.size, served.size, served.logURL)
+		p.schedule(ctx, t)
+	}
+}
+
+// schedule runs the fetch-and-cache for t on the worker pool. If the pool is already
+// at maxWorkers, t is dropped rather than queued: a prefetch is best-effort, and the
+// tile will simply be fetched the ordinary way if a real request reaches it first.
+func (p *prefetcher) schedule(ctx context.Context, t tile) {
+	select {
+	case p.workers <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-p.workers }()
+		if err := p.fetchAndCache(ctx, t); err != nil {
+			log.Printf("prefetching tile %v: %s", t, err)
+		}
+	}()
+}
+
+// fetchAndCache fetches t from the backend and writes it to the cache, unless it's
+// already cached. The cache read goes through tch.cacheGroup, like ServeHTTP's does,
+// so a prefetch of t coalesces with a live request's read/write-through of the same
+// tile instead of racing it.
+func (p *prefetcher) fetchAndCache(ctx context.Context, t tile) error {
+	_, err, _ := p.tch.cacheGroup.Do(t.key(), func() (interface{}, error) {
+		return p.tch.cache.get(ctx, t)
+	})
+	if err == nil {
+		return nil
+	}
+	_, err = p.tch.fetchAndCacheTile(ctx, t)
+	return err
+}
+
+// pollSTH polls the log's get-sth endpoint every interval until ctx is done,
+// prefetching any tiles that have newly become complete at the tree head.
+//
+// completeTiles starts uninitialized rather than at 0: on the first tick, it's set to
+// the tree size already observed, without scheduling anything, so a process restart
+// doesn't treat every historical tile in the log as newly-complete and replay a
+// backfill of the whole log against the backend and the worker pool.
+func (p *prefetcher) pollSTH(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	completeTiles := int64(-1)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		treeSize, err := p.getSTH(ctx)
+		if err != nil {
+			log.Printf("polling get-sth for %s: %s", p.tch.logURL, err)
+			continue
+		}
+
+		size := int64(p.tch.tileSize)
+		newComplete := treeSize / size
+		if completeTiles == -1 {
+			completeTiles = newComplete
+			continue
+		}
+		for i := completeTiles; i < newComplete; i++ {
+			p.schedule(ctx, makeTile(i*size, size, p.tch.logURL))
+		}
+		completeTiles = newComplete
+	}
+}
+
+// getSTH fetches and returns the tree size from the log's get-sth endpoint. It uses
+// tch.backend's configured httpClient, not http.DefaultClient, so a misbehaving
+// upstream log that accepts the connection but never responds can't wedge pollSTH
+// forever: the same connect/read timeouts that bound fetchTile bound this request too.
+func (p *prefetcher) getSTH(ctx context.Context) (int64, error) {
+	url := p.tch.logURL + "/ct/v1/get-sth"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("creating get-sth request: %w", err)
+	}
+	resp, err := p.tch.backend.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("get-sth at %s returned status %d", url, resp.StatusCode)
+	}
+	var sth sthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&sth); err != nil {
+		return 0, fmt.Errorf("decoding get-sth response from %s: %w", url, err)
+	}
+	return sth.TreeSize, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// s3Cache is a tileCache backed by S3. It is the cache of record: every tile ctile
+// has ever completed is kept here, even when a diskCache sits in front of it.
+type s3Cache struct {
+	service      *s3.Client // The S3 service to use for caching tiles. Must not be nil.
+	prefix       string     // The prefix to add to the path when caching tiles in S3. Must not be empty.
+	bucket       string     // The S3 bucket to use for caching tiles. Must not be empty.
+	storageClass string     // The storage class to use when writing tiles, e.g. "STANDARD_IA". Empty means the bucket default.
+	sse          string     // The server-side encryption mode to use when writing tiles, e.g. "aws:kms". Empty means none.
+
+	metrics *metrics // The collectors to record S3 observations into. Must not be nil.
+}
+
+// put stores the entries corresponding to the given tile in s3.
+func (c *s3Cache) put(ctx context.Context, t tile, e *entries) error {
+	if len(e.Entries) != int(t.size) || t.end != t.start+t.size {
+		return fmt.Errorf("internal inconsistency: len(entries) == %d; tile = %v", len(e.Entries), t)
+	}
+	labels := prometheus.Labels{"log_url": t.logURL, "tile_size": strconv.FormatInt(t.size, 10)}
+
+	var body bytes.Buffer
+	w := gzip.NewWriter(&body)
+	err := cbor.NewEncoder(w).Encode(e)
+	if err != nil {
+		return fmt.Errorf("encoding tile %v for s3: %w", t, err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("closing gzip writer: %w", err)
+	}
+
+	key := c.prefix + t.key()
+	putInput := &s3.PutObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body.Bytes()),
+	}
+	if c.storageClass != "" {
+		putInput.StorageClass = types.StorageClass(c.storageClass)
+	}
+	if c.sse != "" {
+		putInput.ServerSideEncryption = types.ServerSideEncryption(c.sse)
+	}
+
+	start := time.Now()
+	_, err = c.service.PutObject(ctx, putInput)
+	c.metrics.s3PutLatency.With(labels).Observe(time.Since(start).Seconds())
+	if err != nil {
+		c.metrics.s3PutErrors.With(labels).Inc()
+		return fmt.Errorf("putting in bucket %q with key %q: %s", c.bucket, key, err)
+	}
+	return nil
+}
+
+// get retrieves the entries corresponding to the given tile from s3.
+// If the tile isn't already stored in s3, it returns a noSuchKey error.
+func (c *s3Cache) get(ctx context.Context, t tile) (*entries, error) {
+	key := c.prefix + t.key()
+	labels := prometheus.Labels{"log_url": t.logURL, "tile_size": strconv.FormatInt(t.size, 10)}
+
+	start := time.Now()
+	resp, err := c.service.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	})
+	c.metrics.s3GetLatency.With(labels).Observe(time.Since(start).Seconds())
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			c.metrics.s3GetErrors.With(prometheus.Labels{
+				"log_url": t.logURL, "tile_size": strconv.FormatInt(t.size, 10), "error_type": "no_such_key",
+			}).Inc()
+			return nil, noSuchKey{}
+		}
+		c.metrics.s3GetErrors.With(prometheus.Labels{
+			"log_url": t.logURL, "tile_size": strconv.FormatInt(t.size, 10), "error_type": "other",
+		}).Inc()
+		return nil, fmt.Errorf("getting from bucket %q with key %q: %w", c.bucket, key, err)
+	}
+
+	var e entries
+	gzipReader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("making gzipReader: %w", err)
+	}
+	err = cbor.NewDecoder(gzipReader).Decode(&e)
+	if err != nil {
+		return nil, fmt.Errorf("reading body from bucket %q with key %q: %w", c.bucket, key, err)
+	}
+
+	if len(e.Entries) != int(t.size) || t.end != t.start+t.size {
+		return nil, fmt.Errorf("internal inconsistency: len(entries) == %d; tile = %v", len(e.Entries), t)
+	}
+
+	return &e, nil
+}